@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+
+	"github.com/toni-moreno/influxdb-srelay/config"
+)
+
+// geoInfo is what geoMiddleware resolves for a request and stashes in its
+// context, for processEndpoint (and anything else downstream) to consult
+// when deciding whether/where to accept a write.
+type geoInfo struct {
+	Country   string
+	Continent string
+	ASN       uint
+}
+
+// geoContextKey is the context key geoMiddleware stores a *geoInfo under.
+type geoContextKey struct{}
+
+// geoInfoFromContext retrieves what geoMiddleware resolved for this
+// request, or nil if geo resolution isn't configured.
+func geoInfoFromContext(ctx context.Context) *geoInfo {
+	info, _ := ctx.Value(geoContextKey{}).(*geoInfo)
+	return info
+}
+
+// GeoMatchRule restricts an endpoint to clients resolving to one of the
+// given countries/continents/ASNs, e.g. routing EU writes to an EU cluster
+// for data-residency. A nil/empty list on a dimension means "unrestricted"
+// on that dimension.
+type GeoMatchRule struct {
+	Countries  []string
+	Continents []string
+	ASNs       []uint
+}
+
+// matches reports whether info satisfies the rule. A nil info (no resolver
+// configured) always matches, since an endpoint shouldn't lose all traffic
+// just because geo resolution isn't set up.
+func (r GeoMatchRule) matches(info *geoInfo) bool {
+	if info == nil {
+		return true
+	}
+	if len(r.Countries) > 0 && !containsString(r.Countries, info.Country) {
+		return false
+	}
+	if len(r.Continents) > 0 && !containsString(r.Continents, info.Continent) {
+		return false
+	}
+	if len(r.ASNs) > 0 && !containsASN(r.ASNs, info.ASN) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsASN(list []uint, v uint) bool {
+	for _, a := range list {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+// GeoResolver wraps the MaxMind readers used to resolve a client IP to a
+// country/continent/ASN, honoring a trusted-proxy list so X-Forwarded-For
+// is only trusted from addresses allowed to set it.
+type GeoResolver struct {
+	city           *geoip2.Reader
+	asn            *geoip2.Reader
+	trustedProxies []*net.IPNet
+}
+
+// NewGeoResolver opens the configured GeoIP2 City and/or ASN databases once,
+// at relay startup, so request handling never pays for a file open.
+func NewGeoResolver(cfg *config.HTTPConfig) (*GeoResolver, error) {
+	gr := &GeoResolver{}
+
+	if cfg.GeoIPCityDB != "" {
+		db, err := geoip2.Open(cfg.GeoIPCityDB)
+		if err != nil {
+			return nil, err
+		}
+		gr.city = db
+	}
+
+	if cfg.GeoIPASNDB != "" {
+		db, err := geoip2.Open(cfg.GeoIPASNDB)
+		if err != nil {
+			return nil, err
+		}
+		gr.asn = db
+	}
+
+	for _, cidr := range cfg.TrustedProxies {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		gr.trustedProxies = append(gr.trustedProxies, n)
+	}
+
+	return gr, nil
+}
+
+// Close releases the underlying mmap'd database files.
+func (gr *GeoResolver) Close() {
+	if gr.city != nil {
+		gr.city.Close()
+	}
+	if gr.asn != nil {
+		gr.asn.Close()
+	}
+}
+
+// clientIP resolves the request's client address, trusting the left-most
+// X-Forwarded-For entry only when RemoteAddr is one of the configured
+// trusted proxies.
+func (gr *GeoResolver) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+
+	if !gr.isTrustedProxy(remote) {
+		return remote
+	}
+
+	xff := r.Header.Get("X-Forwarded-For")
+	if xff == "" {
+		return remote
+	}
+	first := strings.TrimSpace(strings.Split(xff, ",")[0])
+	if ip := net.ParseIP(first); ip != nil {
+		return ip
+	}
+	return remote
+}
+
+func (gr *GeoResolver) isTrustedProxy(ip net.IP) bool {
+	for _, n := range gr.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve looks up country/continent/ASN for ip. Lookups are best-effort:
+// a miss in either database just leaves the corresponding field zero rather
+// than failing the request.
+func (gr *GeoResolver) resolve(ip net.IP) *geoInfo {
+	info := &geoInfo{}
+
+	if gr.city != nil {
+		if rec, err := gr.city.City(ip); err == nil {
+			info.Country = rec.Country.IsoCode
+			info.Continent = rec.Continent.Code
+		}
+	}
+
+	if gr.asn != nil {
+		if rec, err := gr.asn.ASN(ip); err == nil {
+			info.ASN = rec.AutonomousSystemNumber
+		}
+	}
+
+	return info
+}
+
+// geoMiddleware resolves the client's GeoIP/ASN info and stashes it in the
+// request context so processEndpoint can apply country/continent/ASN match
+// rules without re-running the lookup itself.
+func (h *HTTP) geoMiddleware(next relayHandlerFunc) relayHandlerFunc {
+	return func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
+		if h.geo == nil {
+			next(h, w, r, start)
+			return
+		}
+
+		ip := h.geo.clientIP(r)
+		info := h.geo.resolve(ip)
+		ctx := context.WithValue(r.Context(), geoContextKey{}, info)
+		next(h, w, r.WithContext(ctx), start)
+	}
+}
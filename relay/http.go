@@ -1,22 +1,33 @@
 package relay
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/time/rate"
 
 	"context"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/toni-moreno/influxdb-srelay/config"
+	"github.com/toni-moreno/influxdb-srelay/metrics"
+	"github.com/toni-moreno/influxdb-srelay/spool"
 )
 
 // HTTP is a relay for HTTP influxdb writes
@@ -32,13 +43,29 @@ type HTTP struct {
 
 	closing int64
 	l       net.Listener
+	srv     *http.Server
 
 	Endpoints []*HTTPEndPoint
 
 	start time.Time
 	log   *zerolog.Logger
 
-	rateLimiter *rate.Limiter
+	rateLimiter  *rate.Limiter
+	rateLimiters *RateLimiterRegistry
+
+	// endpointLimiters holds a per-endpoint RateLimiterRegistry override,
+	// keyed by endpoint.cfg.URI, for endpoints configured with their own
+	// rate limit instead of inheriting the relay-wide one above.
+	endpointLimiters map[string]*RateLimiterRegistry
+
+	geo      *GeoResolver
+	geoRules map[string]GeoMatchRule // endpoint.cfg.URI -> country/continent/ASN restriction
+
+	// spools holds one write-ahead spool per endpoint URI, used by
+	// processEndpoint as a last resort when every backend 5xx's or times
+	// out. Keyed by endpoint.cfg.URI since that's already the identifier
+	// used for logging and metrics labels elsewhere in this file.
+	spools map[string]*spool.Spool
 }
 
 // httpError writes an error to the client in a standard format.
@@ -56,10 +83,12 @@ type relayMiddleware func(h *HTTP, handlerFunc relayHandlerFunc) relayHandlerFun
 
 // Default HTTP settings and a few constants
 const (
-	DefaultHTTPPingResponse = http.StatusNoContent
-	DefaultHTTPTimeout      = 10 * time.Second
-	DefaultMaxDelayInterval = 10 * time.Second
-	DefaultBatchSizeKB      = 512
+	DefaultHTTPPingResponse     = http.StatusNoContent
+	DefaultHTTPTimeout          = 10 * time.Second
+	DefaultShutdownTimeout      = 30 * time.Second
+	DefaultSpoolMetricsInterval = 15 * time.Second
+	DefaultMaxDelayInterval     = 10 * time.Second
+	DefaultBatchSizeKB          = 512
 
 	KB = 1024
 	MB = 1024 * KB
@@ -72,16 +101,92 @@ var (
 		"/admin":       (*HTTP).handleAdmin,
 		"/admin/flush": (*HTTP).handleFlush,
 		"/health":      (*HTTP).handleHealth,
+		"/metrics":     (*HTTP).handleMetrics,
+		"/tail":        (*HTTP).handleTail,
+		"/ws":          (*HTTP).handleWS,
+		"/admin/spool": (*HTTP).handleAdminSpool,
 	}
 
 	middlewares = []relayMiddleware{
+		(*HTTP).deadlineMiddleware,
+		(*HTTP).geoMiddleware,
 		(*HTTP).bodyMiddleWare,
 		(*HTTP).queryMiddleWare,
 		(*HTTP).logMiddleWare,
 		(*HTTP).rateMiddleware,
 	}
+
+	// routes is handlers flattened into a slice ordered longest-prefix-first,
+	// so ServeHTTP's prefix match is deterministic. Ranging over handlers
+	// directly would work too, except Go randomizes map iteration order per
+	// process, which let a shorter prefix like "/admin" win a race against
+	// "/admin/spool" on some runs.
+	routes = sortedRoutes(handlers)
 )
 
+type routeEntry struct {
+	prefix string
+	fn     relayHandlerFunc
+}
+
+func sortedRoutes(m map[string]relayHandlerFunc) []routeEntry {
+	rs := make([]routeEntry, 0, len(m))
+	for prefix, fn := range m {
+		rs = append(rs, routeEntry{prefix: prefix, fn: fn})
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if len(rs[i].prefix) != len(rs[j].prefix) {
+			return len(rs[i].prefix) > len(rs[j].prefix)
+		}
+		return rs[i].prefix < rs[j].prefix
+	})
+	return rs
+}
+
+// streamingRoutePrefixes lists routes that are expected to stay open far
+// longer than a normal write/query request — /tail and /ws hold their
+// connection for as long as the client wants to keep tailing. Both
+// deadlineMiddleware and Run's http.Server.WriteTimeout need to exempt
+// them, or every stream gets force-closed after one requestTimeout.
+var streamingRoutePrefixes = []string{"/tail", "/ws"}
+
+func isStreamingRoute(path string) bool {
+	for _, p := range streamingRoutePrefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadlineMiddleware gives every request a cancellable, bounded context so
+// a slow or dead backend can't hold a goroutine (and its underlying
+// connection) open indefinitely, and so ProcessInput can tell when it's no
+// longer worth finishing a forward. It also short-circuits requests that
+// arrive after Stop has begun draining, so a rolling restart returns a fast
+// 503 instead of accepting work it can't finish. Streaming routes opt out
+// of the bounded context entirely: they're meant to live far longer than
+// requestTimeout, and rely on their own keepalive/close handling instead.
+func (h *HTTP) deadlineMiddleware(next relayHandlerFunc) relayHandlerFunc {
+	return func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
+		if atomic.LoadInt64(&h.closing) != 0 {
+			w.Header().Set("Retry-After", "1")
+			h.httpError(w, "relay is shutting down, retry shortly", http.StatusServiceUnavailable)
+			return
+		}
+
+		if isStreamingRoute(r.URL.Path) {
+			next(h, w, r, start)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), h.requestTimeout())
+		defer cancel()
+
+		next(h, w, r.WithContext(ctx), start)
+	}
+}
+
 // NewHTTP creates a new HTTP relay
 // This relay will most likely be tied to a RelayService
 // and manage a set of HTTPBackends
@@ -98,7 +203,7 @@ func NewHTTP(cfg *config.HTTPConfig) (Relay, error) {
 		i = os.Stderr
 	}
 
-	f := log.Output(zerolog.ConsoleWriter{Out: i})
+	f := log.Output(zerolog.MultiLevelWriter(zerolog.ConsoleWriter{Out: i}, zerolog.ConsoleWriter{Out: logBroadcastWriter{}, NoColor: true}))
 	h.log = &f
 
 	switch cfg.LogLevel {
@@ -144,6 +249,16 @@ func NewHTTP(cfg *config.HTTPConfig) (Relay, error) {
 		h.log.Info().Msgf("ENDPOINT [%d] | %+v", i, b)
 	}
 
+	for _, ep := range h.Endpoints {
+		if ep.cfg.RateLimit == 0 {
+			continue
+		}
+		if h.endpointLimiters == nil {
+			h.endpointLimiters = make(map[string]*RateLimiterRegistry)
+		}
+		h.endpointLimiters[ep.cfg.URI] = newRateLimiterRegistryForEndpoint(ep.cfg)
+	}
+
 	// If a RateLimit is specified, create a new limiter
 	if cfg.RateLimit != 0 {
 		if cfg.BurstLimit != 0 {
@@ -152,9 +267,101 @@ func NewHTTP(cfg *config.HTTPConfig) (Relay, error) {
 			h.rateLimiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), 1)
 		}
 	}
+
+	// A per-key registry takes over from the single global limiter above
+	// whenever the config asks for it, letting each tenant/cluster/db get
+	// its own bucket instead of sharing one fleet-wide allowance.
+	if cfg.RateLimitKeyBy != nil {
+		h.rateLimiters = NewRateLimiterRegistry(cfg)
+	}
+
+	if cfg.GeoIPCityDB != "" || cfg.GeoIPASNDB != "" {
+		geo, err := NewGeoResolver(cfg)
+		if err != nil {
+			h.log.Err(err)
+			return nil, err
+		}
+		h.geo = geo
+	}
+
+	if len(cfg.GeoEndpointRules) > 0 {
+		h.geoRules = make(map[string]GeoMatchRule, len(cfg.GeoEndpointRules))
+		for uri, rule := range cfg.GeoEndpointRules {
+			h.geoRules[uri] = GeoMatchRule{
+				Countries:  rule.Countries,
+				Continents: rule.Continents,
+				ASNs:       rule.ASNs,
+			}
+		}
+	}
+
+	if cfg.SpoolDir != "" {
+		h.spools = make(map[string]*spool.Spool)
+		for _, ep := range h.Endpoints {
+			sp, err := spool.Open(spool.Config{Dir: filepath.Join(cfg.SpoolDir, sanitizeSpoolName(ep.cfg.URI))})
+			if err != nil {
+				h.log.Err(err)
+				return nil, err
+			}
+			h.spools[ep.cfg.URI] = sp
+			go sp.Replay(h.replaySender(ep.cfg.URI))
+			go h.reportSpoolMetrics(ep.cfg.URI, sp)
+		}
+	}
+
 	return h, nil
 }
 
+// reportSpoolMetrics keeps the spool_backlog_bytes/spool_oldest_segment_age
+// gauges fresh on a fixed tick, independent of whether anyone is polling
+// GET /admin/spool, so alerting on a stuck replayer doesn't depend on an
+// operator happening to look.
+func (h *HTTP) reportSpoolMetrics(endpoint string, sp *spool.Spool) {
+	ticker := time.NewTicker(DefaultSpoolMetricsInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt64(&h.closing) != 0 {
+			return
+		}
+		metrics.SpoolBacklogBytes.WithLabelValues(endpoint).Set(float64(sp.BacklogBytes()))
+		metrics.SpoolOldestSegmentAgeSeconds.WithLabelValues(endpoint).Set(sp.OldestSegmentAge().Seconds())
+	}
+}
+
+// replaySender builds the spool.Sender used to drain a given endpoint's
+// backlog: a plain POST of the spooled batch back to the endpoint that
+// originally rejected it, since by the time it replays there's no live
+// ResponseWriter to route the request through processEndpoint.
+func (h *HTTP) replaySender(target string) spool.Sender {
+	client := &http.Client{Timeout: h.requestTimeout()}
+	return func(e spool.Entry) error {
+		req, err := http.NewRequest(http.MethodPost, e.Target, bytes.NewReader(e.Body))
+		if err != nil {
+			return err
+		}
+		for k, v := range e.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("replay to %s: backend returned %d", target, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// sanitizeSpoolName turns an endpoint URI into a filesystem-safe directory
+// component, since URIs contain characters (":", "/") that aren't valid in
+// a path segment on every platform the relay runs on.
+func sanitizeSpoolName(uri string) string {
+	r := strings.NewReplacer("://", "_", "/", "_", ":", "_")
+	return r.Replace(uri)
+}
+
 // Name is the name of the HTTP relay
 // a default name might be generated if it is
 // not specified in the configuration file
@@ -167,38 +374,117 @@ func (h *HTTP) Name() string {
 
 // Run actually launch the HTTP endpoint
 func (h *HTTP) Run() error {
-	var cert tls.Certificate
 	l, err := net.Listen("tcp", h.cfg.BindAddr)
 	if err != nil {
 		return err
 	}
+	h.l = l
+
+	var handler http.Handler = h
+
+	srv := &http.Server{
+		Handler:           handler,
+		IdleTimeout:       h.cfg.IdleTimeout,
+		ReadHeaderTimeout: h.requestTimeout(),
+		WriteTimeout:      h.requestTimeout(),
+		BaseContext: func(net.Listener) context.Context {
+			return context.Background()
+		},
+	}
 
-	// support HTTPS
 	if h.cert != "" {
-		cert, err = tls.LoadX509KeyPair(h.cert, h.cert)
-		if err != nil {
-			return err
+		srv.TLSConfig = &tls.Config{}
+	}
+
+	if h.cfg.HTTP2 {
+		h2cfg := &http2.Server{
+			MaxConcurrentStreams: h.cfg.MaxConcurrentStreams,
+			IdleTimeout:          h.cfg.IdleTimeout,
 		}
 
-		l = tls.NewListener(l, &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		})
+		// h.cert == "" means this is a cleartext listener, so HTTP/2
+		// can only be reached via prior-knowledge (h2c); otherwise
+		// http2.ConfigureServer must run before ServeTLS below, since it's
+		// what adds "h2" to srv.TLSConfig.NextProtos — ServeTLS then hands
+		// that same TLSConfig to the real listener, so ALPN actually
+		// negotiates h2 on it instead of a throwaway tls.Config nothing
+		// ever serves from.
+		if h.cert == "" {
+			if h.cfg.H2C {
+				srv.Handler = h2c.NewHandler(handler, h2cfg)
+			}
+		} else {
+			if err := http2.ConfigureServer(srv, h2cfg); err != nil {
+				return err
+			}
+		}
+	} else if h.cert != "" {
+		// ServeTLS auto-negotiates h2 via ALPN whenever TLSNextProto is
+		// left nil, regardless of cfg.HTTP2. An empty (non-nil) map is
+		// ServeTLS's documented way to opt a listener out of that default,
+		// so cfg.HTTP2: false actually keeps the TLS listener on HTTP/1.1.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
 	}
 
-	h.l = l
+	h.srv = srv
 
 	h.log.Printf("starting %s relay %q on %v", strings.ToUpper(h.schema), h.Name(), h.cfg.BindAddr)
 
-	err = http.Serve(l, h)
-	if atomic.LoadInt64(&h.closing) != 0 {
+	// NOTE: a future gRPC ingest endpoint can be mounted on this same
+	// listener by sniffing the connection preface (cmux-style) before
+	// handing it to srv.Serve/grpc.Server, so operators don't need a
+	// second port for write traffic.
+	if h.cert != "" {
+		err = srv.ServeTLS(l, h.cert, h.cert)
+	} else {
+		err = srv.Serve(l)
+	}
+	if err == http.ErrServerClosed || atomic.LoadInt64(&h.closing) != 0 {
 		return nil
 	}
 	return err
 }
 
-// Stop actually stops the HTTP endpoint
+// requestTimeout returns the configured per-request deadline, falling back
+// to DefaultHTTPTimeout when the relay config doesn't set one.
+func (h *HTTP) requestTimeout() time.Duration {
+	if h.cfg.RequestTimeout > 0 {
+		return h.cfg.RequestTimeout
+	}
+	return DefaultHTTPTimeout
+}
+
+// Stop actually stops the HTTP endpoint, draining in-flight requests instead
+// of cutting them off. The listener stops accepting at once; writes already
+// in progress get up to cfg.ShutdownTimeout (DefaultShutdownTimeout if
+// unset) to finish, after which Shutdown returns the context's error.
 func (h *HTTP) Stop() error {
 	atomic.StoreInt64(&h.closing, 1)
+
+	drain := h.cfg.ShutdownTimeout
+	if drain <= 0 {
+		drain = DefaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	for uri, sp := range h.spools {
+		if err := sp.Close(); err != nil {
+			h.log.Err(err).Msgf("spool: failed closing spool for %s", uri)
+		}
+	}
+
+	if h.rateLimiters != nil {
+		h.rateLimiters.Close()
+	}
+	for _, limiter := range h.endpointLimiters {
+		limiter.Close()
+	}
+
+	if h.srv != nil {
+		return h.srv.Shutdown(ctx)
+	}
 	return h.l.Close()
 }
 
@@ -242,33 +528,205 @@ func (h *HTTP) handleFlush(w http.ResponseWriter, r *http.Request, start time.Ti
 	h.log.Error().Msgf("Handle Flush for cluster Error cluster %s not exist", clusterid.(string))
 }
 
+// handleMetrics exposes the process' Prometheus collectors for pull-based
+// scraping on the same listener, gated by cfg.MetricsEnabled so operators
+// who don't run Prometheus don't pay for the extra route.
+func (h *HTTP) handleMetrics(w http.ResponseWriter, r *http.Request, start time.Time) {
+	if !h.cfg.MetricsEnabled {
+		h.httpError(w, "metrics disabled", http.StatusNotFound)
+		return
+	}
+	promhttp.Handler().ServeHTTP(w, r)
+}
+
 func (h *HTTP) processEndpoint(w http.ResponseWriter, r *http.Request, start time.Time) {
+	// Snapshot the body once up front: ProcessInput consumes r.Body to
+	// forward the batch, so by the time every endpoint has failed there's
+	// nothing left in it to spool. Each attempt below gets its own fresh
+	// reader over the same bytes.
+	var bodyBytes []byte
+	if len(h.spools) > 0 {
+		bodyBytes, _ = io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	}
+
+	geo := geoInfoFromContext(r.Context())
+
 	// Begin process for
+	var lastEndpoint *HTTPEndPoint
+	var rateLimitedBy *rate.Limiter
+	tried := 0
 	for i, endpoint := range h.Endpoints {
+		if rule, ok := h.geoRules[endpoint.cfg.URI]; ok && !rule.matches(geo) {
+			h.log.Debug().Msgf("skipping [%d][%s] endpoint %+v: client geo does not match", i, endpoint.cfg.Type, endpoint.cfg.URI)
+			continue
+		}
+
+		if limiter, ok := h.endpointLimiters[endpoint.cfg.URI]; ok {
+			key := limiter.keyFor(r)
+			l := limiter.limiterFor(key)
+			if !l.Allow() {
+				metrics.RateLimitedTotal.Inc()
+				h.log.Debug().Msgf("skipping [%d][%s] endpoint %+v: endpoint rate limit exceeded", i, endpoint.cfg.Type, endpoint.cfg.URI)
+				rateLimitedBy = l
+				continue
+			}
+		}
+
+		tried++
 		h.log.Info().Msgf("Procesing [%d][%s] endpoint %+v", i, endpoint.cfg.Type, endpoint.cfg.URI)
 		processed := endpoint.ProcessInput(w, r, start)
 		if processed {
-			break
+			metrics.BackendRequestsTotal.WithLabelValues(endpoint.cfg.URI, "success").Inc()
+			return
+		}
+		metrics.BackendRequestsTotal.WithLabelValues(endpoint.cfg.URI, "failure").Inc()
+		lastEndpoint = endpoint
+		if bodyBytes != nil {
+			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 		}
 	}
+
+	// Every backend rejected or timed out on this batch; spool it for the
+	// background replayer instead of dropping it on the floor.
+	if lastEndpoint != nil {
+		h.spoolFailedWrite(lastEndpoint, r.Header, bodyBytes)
+		return
+	}
+
+	// No endpoint was even tried: every one was skipped by a geo rule or an
+	// exhausted per-endpoint rate limit, so nothing above wrote a response
+	// and the client would otherwise silently get Go's default 200. Write
+	// an explicit terminal response instead of dropping the write.
+	if tried == 0 {
+		if rateLimitedBy != nil {
+			writeRateLimited(w, rateLimitedBy)
+			return
+		}
+		h.httpError(w, "no endpoint available for this client", http.StatusServiceUnavailable)
+	}
+}
+
+// spoolFailedWrite persists a batch that every backend 5xx'd or timed out
+// on, so the endpoint's spool.Replay goroutine started in NewHTTP can retry
+// it once the backend recovers. An endpoint with no spool is skipped
+// silently and a write error is logged and otherwise swallowed: the client
+// already got its response from
+// the failed attempt above, so there's nothing left to report to it.
+func (h *HTTP) spoolFailedWrite(endpoint *HTTPEndPoint, header http.Header, body []byte) {
+	sp, ok := h.spools[endpoint.cfg.URI]
+	if !ok {
+		return
+	}
+
+	headers := make(map[string]string, len(header))
+	for k := range header {
+		headers[k] = header.Get(k)
+	}
+
+	entry := spool.Entry{Target: endpoint.cfg.URI, Headers: headers, Body: body}
+	if err := sp.Write(entry); err != nil {
+		h.log.Err(err).Msg("spool: failed writing entry")
+	}
 }
 
 var ProcessEndpoint relayHandlerFunc = (*HTTP).processEndpoint
 
+// statusWriter wraps an http.ResponseWriter to capture the status code
+// written, so metrics can label requests by outcome after the fact.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	metrics.BytesOut.Add(float64(n))
+	return n, err
+}
+
+// Flush and Hijack pass through to the underlying ResponseWriter instead of
+// being silently dropped by the embedding. Go only promotes methods declared
+// on the embedded field's static type, so without these, wrapping every
+// response in *statusWriter would make w.(http.Flusher) and
+// w.(http.Hijacker) fail for every request — breaking /tail's SSE flushing
+// and /ws's WebSocket upgrade.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("statusWriter: underlying ResponseWriter does not support Hijack")
+	}
+	return hj.Hijack()
+}
+
+// Unwrap lets http.NewResponseController reach the underlying
+// ResponseWriter, so handleTail can clear its write deadline.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// requestBodyCounter wraps r.Body so every byte any handler reads from a
+// request body counts toward metrics.BytesIn, mirroring how statusWriter
+// counts metrics.BytesOut on the way out.
+type requestBodyCounter struct {
+	io.ReadCloser
+}
+
+func (c requestBodyCounter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	metrics.BytesIn.Add(float64(n))
+	return n, err
+}
+
 // ServeHTTP is the function that handles the different route
 // The response is a JSON object describing the state of the operation
 func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// h.start = time.Now()
 	h.log.Debug().Msgf("IN REQUEST:%+v", r)
 
-	for url, fun := range handlers {
-		if strings.HasPrefix(r.URL.Path, url) {
-			clusterid := strings.TrimPrefix(r.URL.Path, url+"/")
+	metrics.RequestsInFlight.Inc()
+	defer metrics.RequestsInFlight.Dec()
+
+	if r.Body != nil {
+		r.Body = requestBodyCounter{r.Body}
+	}
+
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	route := "write"
+
+	for _, rt := range routes {
+		if strings.HasPrefix(r.URL.Path, rt.prefix) {
+			route = rt.prefix
+			clusterid := strings.TrimPrefix(r.URL.Path, rt.prefix+"/")
 			ctx := context.WithValue(r.Context(), "clusterid", clusterid)
-			allMiddlewares(h, fun)(h, w, r.WithContext(ctx), time.Now())
+			allMiddlewares(h, rt.fn)(h, sw, r.WithContext(ctx), time.Now())
+			h.recordRequestMetrics(route, sw.status, start)
 			return
 		}
 
 	}
-	allMiddlewares(h, ProcessEndpoint)(h, w, r, time.Now())
+	allMiddlewares(h, ProcessEndpoint)(h, sw, r, time.Now())
+	h.recordRequestMetrics(route, sw.status, start)
+}
+
+// recordRequestMetrics updates the request counter and latency histogram
+// once a request has been fully handled.
+func (h *HTTP) recordRequestMetrics(route string, status int, start time.Time) {
+	metrics.RequestsTotal.WithLabelValues(route, strconv.Itoa(status)).Inc()
+	metrics.RequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
 }
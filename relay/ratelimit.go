@@ -0,0 +1,277 @@
+package relay
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/toni-moreno/influxdb-srelay/config"
+	"github.com/toni-moreno/influxdb-srelay/metrics"
+)
+
+// RateLimitMode selects the algorithm used by a RateLimiterRegistry entry.
+type RateLimitMode int
+
+const (
+	// TokenBucket allows short bursts above the sustained rate, up to Burst.
+	TokenBucket RateLimitMode = iota
+	// LeakyBucket smooths traffic out to a constant rate with no burst
+	// allowance, trading burst tolerance for a steadier backend load.
+	LeakyBucket
+)
+
+// DefaultRateLimiterIdleTTL is how long a per-key limiter can sit unused
+// before it becomes eligible for eviction from the registry.
+const DefaultRateLimiterIdleTTL = 10 * time.Minute
+
+// DefaultRateLimiterCacheSize bounds the number of distinct keys tracked at
+// once, so a registry keyed on something high-cardinality (e.g. remote IP)
+// can't grow without limit under a long-lived relay process.
+const DefaultRateLimiterCacheSize = 10000
+
+// rateLimiterEntry is the value stored per key, plus the bookkeeping the LRU
+// needs to find and evict it.
+type rateLimiterEntry struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	listElem *list.Element
+}
+
+// RateLimiterRegistry maintains one *rate.Limiter per key (tenant, cluster,
+// DB, or any combination thereof) instead of the single global limiter
+// HTTP.rateLimiter applies uniformly. Idle keys are evicted LRU-style, the
+// same eviction strategy groupcache/lru uses, so memory stays bounded under
+// many tenants; idle entries are also swept out on a timer so a registry
+// that never fills up still gives up the memory for keys nobody's used in
+// a while (e.g. a tenant that churned through a handful of requests once).
+type RateLimiterRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*rateLimiterEntry
+	lru     *list.List
+
+	keyBy   []string
+	mode    RateLimitMode
+	rateHz  float64
+	burst   int
+	maxSize int
+	idleTTL time.Duration
+
+	stop chan struct{}
+}
+
+// NewRateLimiterRegistry builds a registry from a rate-limit config.
+// cfg.RateLimitKeyBy picks the components combined into a key, e.g.
+// []string{"clusterid", "db"}; recognized components are "ip", "clusterid",
+// "db", and "user" (from the X-Auth-User header). It starts a background
+// sweep of idle entries; call Close when the registry is no longer needed
+// to stop it.
+func NewRateLimiterRegistry(cfg *config.HTTPConfig) *RateLimiterRegistry {
+	rr := newRateLimiterRegistry(cfg.RateLimitMode, cfg.RateLimit, cfg.BurstLimit, cfg.RateLimitKeyBy, cfg.RateLimitCacheSize, cfg.RateLimitIdleTTL)
+	go rr.sweepLoop()
+	return rr
+}
+
+// newRateLimiterRegistryForEndpoint builds the per-endpoint override
+// registry consulted by processEndpoint before it forwards to a given
+// HTTPEndPoint, so a single noisy endpoint can be throttled independent of
+// the relay-wide h.rateLimiters registry above.
+func newRateLimiterRegistryForEndpoint(epc *config.HTTPEndPointConfig) *RateLimiterRegistry {
+	rr := newRateLimiterRegistry(epc.RateLimitMode, epc.RateLimit, epc.BurstLimit, epc.RateLimitKeyBy, epc.RateLimitCacheSize, epc.RateLimitIdleTTL)
+	go rr.sweepLoop()
+	return rr
+}
+
+func newRateLimiterRegistry(modeStr string, rateHz float64, burstLimit int, keyBy []string, cacheSize int, idleTTL time.Duration) *RateLimiterRegistry {
+	mode := TokenBucket
+	if strings.EqualFold(modeStr, "leaky") {
+		mode = LeakyBucket
+	}
+
+	burst := burstLimit
+	if burst == 0 {
+		burst = 1
+	}
+
+	size := cacheSize
+	if size == 0 {
+		size = DefaultRateLimiterCacheSize
+	}
+
+	if idleTTL == 0 {
+		idleTTL = DefaultRateLimiterIdleTTL
+	}
+
+	return &RateLimiterRegistry{
+		entries: make(map[string]*rateLimiterEntry),
+		lru:     list.New(),
+		keyBy:   keyBy,
+		mode:    mode,
+		rateHz:  rateHz,
+		burst:   burst,
+		maxSize: size,
+		idleTTL: idleTTL,
+		stop:    make(chan struct{}),
+	}
+}
+
+// Close stops the background idle sweep.
+func (rr *RateLimiterRegistry) Close() {
+	close(rr.stop)
+}
+
+// sweepLoop runs sweepIdle on a fixed tick (half the idle TTL, so an entry
+// doesn't outlive its TTL by much) until Close is called.
+func (rr *RateLimiterRegistry) sweepLoop() {
+	interval := rr.idleTTL / 2
+	if interval <= 0 {
+		interval = DefaultRateLimiterIdleTTL / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rr.stop:
+			return
+		case now := <-ticker.C:
+			rr.sweepIdle(now)
+		}
+	}
+}
+
+// keyFor builds the registry key for a request out of the configured
+// components. Unknown components are ignored so a typo in config degrades to
+// a coarser key rather than a panic.
+func (rr *RateLimiterRegistry) keyFor(r *http.Request) string {
+	ctx := r.Context()
+	parts := make([]string, 0, len(rr.keyBy))
+	for _, k := range rr.keyBy {
+		switch k {
+		case "ip":
+			parts = append(parts, remoteIP(r))
+		case "clusterid":
+			if v, ok := ctx.Value("clusterid").(string); ok {
+				parts = append(parts, v)
+			}
+		case "db":
+			parts = append(parts, r.URL.Query().Get("db"))
+		case "user":
+			parts = append(parts, r.Header.Get("X-Auth-User"))
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limiterFor returns the limiter for key, creating it (and evicting the
+// least-recently-used entry if the registry is full) on first use.
+func (rr *RateLimiterRegistry) limiterFor(key string) *rate.Limiter {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if e, ok := rr.entries[key]; ok {
+		e.lastSeen = time.Now()
+		rr.lru.MoveToFront(e.listElem)
+		return e.limiter
+	}
+
+	if len(rr.entries) >= rr.maxSize {
+		rr.evictOldestLocked()
+	}
+
+	var limiter *rate.Limiter
+	switch rr.mode {
+	case LeakyBucket:
+		// No burst allowance: the bucket leaks at a constant rate.
+		limiter = rate.NewLimiter(rate.Limit(rr.rateHz), 1)
+	default:
+		limiter = rate.NewLimiter(rate.Limit(rr.rateHz), rr.burst)
+	}
+
+	e := &rateLimiterEntry{key: key, limiter: limiter, lastSeen: time.Now()}
+	e.listElem = rr.lru.PushFront(e)
+	rr.entries[key] = e
+	return limiter
+}
+
+// evictOldestLocked drops the least-recently-used entry. Callers must hold
+// rr.mu.
+func (rr *RateLimiterRegistry) evictOldestLocked() {
+	oldest := rr.lru.Back()
+	if oldest == nil {
+		return
+	}
+	e := oldest.Value.(*rateLimiterEntry)
+	rr.lru.Remove(oldest)
+	delete(rr.entries, e.key)
+}
+
+// sweepIdle drops entries that haven't been touched within idleTTL. sweepLoop
+// runs it on a ticker, so a low-traffic relay whose cache never fills up
+// (and so never hits limiterFor's LRU eviction) still frees idle keys.
+func (rr *RateLimiterRegistry) sweepIdle(now time.Time) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	for e := rr.lru.Back(); e != nil; {
+		entry := e.Value.(*rateLimiterEntry)
+		if now.Sub(entry.lastSeen) < rr.idleTTL {
+			break
+		}
+		prev := e.Prev()
+		rr.lru.Remove(e)
+		delete(rr.entries, entry.key)
+		e = prev
+	}
+}
+
+// rateMiddleware enforces either the single global h.rateLimiter or, when
+// configured, the per-key h.rateLimiters registry. Requests over the limit
+// get a 429 with Retry-After and X-RateLimit-* headers instead of being
+// forwarded to a backend.
+func (h *HTTP) rateMiddleware(next relayHandlerFunc) relayHandlerFunc {
+	return func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
+		if h.rateLimiters != nil {
+			key := h.rateLimiters.keyFor(r)
+			limiter := h.rateLimiters.limiterFor(key)
+			if !limiter.Allow() {
+				metrics.RateLimitedTotal.Inc()
+				writeRateLimited(w, limiter)
+				return
+			}
+			next(h, w, r, start)
+			return
+		}
+
+		if h.rateLimiter != nil && !h.rateLimiter.Allow() {
+			metrics.RateLimitedTotal.Inc()
+			writeRateLimited(w, h.rateLimiter)
+			return
+		}
+
+		next(h, w, r, start)
+	}
+}
+
+// writeRateLimited writes the standard 429 response for a throttled request.
+func writeRateLimited(w http.ResponseWriter, limiter *rate.Limiter) {
+	retryAfter := time.Second
+	w.Header().Set("Retry-After", fmt.Sprintf("%.0f", retryAfter.Seconds()))
+	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%.0f", float64(limiter.Limit())))
+	w.Header().Set("X-RateLimit-Remaining", "0")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(`{"error":"rate limit exceeded"}`))
+}
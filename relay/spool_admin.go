@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/toni-moreno/influxdb-srelay/metrics"
+)
+
+// spoolStatus is the per-endpoint view returned by GET /admin/spool.
+type spoolStatus struct {
+	Endpoint         string   `json:"endpoint"`
+	QueueDepth       int      `json:"queue_depth"`
+	BacklogBytes     int64    `json:"backlog_bytes"`
+	OldestSegmentAge float64  `json:"oldest_segment_age_seconds"`
+	Segments         []string `json:"segments"`
+}
+
+// handleAdminSpool reports queue depth/backlog/oldest-segment-age and the
+// sealed segment file names for every endpoint's spool on GET, and on POST
+// applies action=pause|resume|drop to the spool named by the endpoint=
+// query param (drop additionally requires segment=, one of the names from
+// the GET response) so an
+// operator can intervene on a poisoned segment without restarting the
+// relay.
+func (h *HTTP) handleAdminSpool(w http.ResponseWriter, r *http.Request, start time.Time) {
+	if len(h.spools) == 0 {
+		h.httpError(w, "spool not configured", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		h.handleAdminSpoolAction(w, r)
+		return
+	}
+
+	statuses := make([]spoolStatus, 0, len(h.spools))
+	for endpoint, sp := range h.spools {
+		age := sp.OldestSegmentAge().Seconds()
+		backlog := sp.BacklogBytes()
+
+		metrics.SpoolBacklogBytes.WithLabelValues(endpoint).Set(float64(backlog))
+		metrics.SpoolOldestSegmentAgeSeconds.WithLabelValues(endpoint).Set(age)
+
+		statuses = append(statuses, spoolStatus{
+			Endpoint:         endpoint,
+			QueueDepth:       sp.QueueDepth(),
+			BacklogBytes:     backlog,
+			OldestSegmentAge: age,
+			Segments:         sp.Segments(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func (h *HTTP) handleAdminSpoolAction(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.URL.Query().Get("endpoint")
+	sp, ok := h.spools[endpoint]
+	if !ok {
+		h.httpError(w, "unknown spool endpoint", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Query().Get("action") {
+	case "pause":
+		sp.Pause()
+	case "resume":
+		sp.Resume()
+	case "drop":
+		if err := sp.DropSegment(r.URL.Query().Get("segment")); err != nil {
+			h.httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		h.httpError(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,386 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultTailInterval is how often a query-mode tail re-issues its query
+// against the backend when the client doesn't specify one.
+const DefaultTailInterval = 5 * time.Second
+
+// DefaultWSMaxMessageSize caps a single WebSocket message read from the
+// client (conn.SetReadLimit) when cfg.WSMaxMessageSize is unset. Messages
+// the relay writes are not limited by it.
+const DefaultWSMaxMessageSize = 4 * MB
+
+// logLine is one entry published to logBroadcast, tagged with enough to let
+// subscribers filter by cluster/level without re-parsing the rendered text.
+// A subscriber that asked for a specific clusterid/level only ever sees
+// lines tagged with that exact value; a line the tagger couldn't confidently
+// tag (empty clusterid/level) is treated as not matching rather than passed
+// through to every filtered subscriber.
+type logLine struct {
+	clusterid string
+	level     string
+	text      []byte
+}
+
+// logBroadcaster fans a single stream of log lines out to any number of
+// /tail or /ws subscribers. Publish is called from the log writer installed
+// in NewHTTP; it never blocks on a slow subscriber, it drops for it instead,
+// since a stuck tail client must never back up request logging.
+type logBroadcaster struct {
+	mu   sync.Mutex
+	subs map[chan logLine]struct{}
+}
+
+func newLogBroadcaster() *logBroadcaster {
+	return &logBroadcaster{subs: make(map[chan logLine]struct{})}
+}
+
+func (b *logBroadcaster) subscribe() chan logLine {
+	ch := make(chan logLine, 64)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *logBroadcaster) unsubscribe(ch chan logLine) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+	close(ch)
+}
+
+func (b *logBroadcaster) publish(line logLine) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- line:
+		default:
+			// Subscriber is behind; drop the line rather than block logging.
+		}
+	}
+}
+
+// logBroadcast is the process-wide fanout used by handleTail/handleWS.
+var logBroadcast = newLogBroadcaster()
+
+// zerolog's ConsoleWriter renders each line roughly as
+// "<timestamp> <LVL> <message> key=value ...". clusterLogPattern pulls the
+// cluster id out of the handlers in this file that log "... for cluster
+// <id>" (handlePing/handleStatus/handleHealth/handleFlush); levelLogPattern
+// pulls the three-letter level abbreviation so it can be matched against
+// the full level name the /tail and /ws "level" query param uses.
+var (
+	clusterLogPattern = regexp.MustCompile(`\bcluster (\S+)`)
+	levelLogPattern   = regexp.MustCompile(`\b(TRC|DBG|INF|WRN|ERR|FTL|PAN)\b`)
+
+	levelAbbrevToName = map[string]string{
+		"TRC": "trace",
+		"DBG": "debug",
+		"INF": "info",
+		"WRN": "warn",
+		"ERR": "error",
+		"FTL": "fatal",
+		"PAN": "panic",
+	}
+)
+
+// logBroadcastWriter is installed alongside the relay's normal log output so
+// every line written to the zerolog logger also reaches logBroadcast,
+// without the handlers needing a reference back into the logger internals.
+// It tags each line with the cluster/level it can recover from the
+// rendered text, best-effort, since nothing upstream threads a per-request
+// logger through the handlers that would let it tag lines precisely.
+type logBroadcastWriter struct{}
+
+func (logBroadcastWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	ll := logLine{text: line}
+	if m := clusterLogPattern.FindSubmatch(line); m != nil {
+		ll.clusterid = strings.TrimRight(string(m[1]), ".,;")
+	}
+	if m := levelLogPattern.FindSubmatch(line); m != nil {
+		ll.level = levelAbbrevToName[string(m[1])]
+	}
+
+	logBroadcast.publish(ll)
+	return len(p), nil
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4 * KB,
+	WriteBufferSize: 4 * KB,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// handleTail serves Server-Sent Events: either the relay's own log stream
+// (source=log, the default) filtered by clusterid/level, or a backend query
+// re-issued on an interval (source=query).
+func (h *HTTP) handleTail(w http.ResponseWriter, r *http.Request, start time.Time) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.httpError(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// srv.WriteTimeout bounds a normal request/response; a tail is meant to
+	// stay open indefinitely, so disable it for this response rather than
+	// have the connection force-closed out from under the stream.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if r.URL.Query().Get("source") == "query" {
+		h.tailQuery(w, flusher, r)
+		return
+	}
+	h.tailLog(w, flusher, r)
+}
+
+func (h *HTTP) tailLog(w http.ResponseWriter, flusher http.Flusher, r *http.Request) {
+	clusterid, _ := r.Context().Value("clusterid").(string)
+	level := r.URL.Query().Get("level")
+
+	sub := logBroadcast.subscribe()
+	defer logBroadcast.unsubscribe(sub)
+
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line := <-sub:
+			if clusterid != "" && line.clusterid != clusterid {
+				continue
+			}
+			if level != "" && line.level != level {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", line.text)
+			flusher.Flush()
+		}
+	}
+}
+
+func (h *HTTP) tailQuery(w http.ResponseWriter, flusher http.Flusher, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	idx, _ := strconv.Atoi(r.URL.Query().Get("endpoint"))
+	interval := DefaultTailInterval
+	if v := r.URL.Query().Get("interval"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			interval = d
+		}
+	}
+
+	if idx < 0 || idx >= len(h.Endpoints) {
+		fmt.Fprintf(w, "event: error\ndata: unknown endpoint %d\n\n", idx)
+		flusher.Flush()
+		return
+	}
+	endpoint := h.Endpoints[idx]
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ctx := r.Context()
+	client := &http.Client{Timeout: h.requestTimeout()}
+
+	for {
+		resp, err := client.Get(fmt.Sprintf("%s/query?q=%s", endpoint.cfg.URI, url.QueryEscape(q)))
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+		} else {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			fmt.Fprintf(w, "data: %s\n\n", body)
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// wsPongWait bounds how long a WebSocket tail waits for a pong before the
+// connection is considered dead; wsPingPeriod is how often a ping is sent
+// to keep it from going stale behind a load balancer's idle timeout.
+const (
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+// handleWS upgrades to a WebSocket and streams the same log/query sources as
+// handleTail (source=log, the default, or source=query), framed as
+// individual WebSocket text messages instead of SSE events. A configurable
+// max message size caps what the client may send; results are written
+// whole, split into frames by the WebSocket writer as needed. Ping/pong
+// keepalive keeps a long-lived tail from going stale behind a load
+// balancer's idle timeout.
+func (h *HTTP) handleWS(w http.ResponseWriter, r *http.Request, start time.Time) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.log.Err(err).Msg("ws upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	// Upgrade hijacks the underlying net.Conn out of srv's control, but any
+	// deadline srv already set on it before the handler ran stays in
+	// effect. Clear it so srv.WriteTimeout doesn't kill a long-lived
+	// WebSocket session out from under us.
+	conn.UnderlyingConn().SetDeadline(time.Time{})
+
+	maxSize := int64(h.cfg.WSMaxMessageSize)
+	if maxSize <= 0 {
+		maxSize = DefaultWSMaxMessageSize
+	}
+	conn.SetReadLimit(maxSize)
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	// The client doesn't send anything we act on, but we still need to
+	// drain its control frames (pong, close) to keep the connection alive.
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if r.URL.Query().Get("source") == "query" {
+		h.wsQuery(conn, r)
+		return
+	}
+	h.wsLog(conn, r)
+}
+
+// wsLog streams the relay's log broadcast over conn, filtered by
+// clusterid/level exactly like tailLog does for SSE.
+func (h *HTTP) wsLog(conn *websocket.Conn, r *http.Request) {
+	clusterid, _ := r.Context().Value("clusterid").(string)
+	level := r.URL.Query().Get("level")
+
+	sub := logBroadcast.subscribe()
+	defer logBroadcast.unsubscribe(sub)
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case line := <-sub:
+			if clusterid != "" && line.clusterid != clusterid {
+				continue
+			}
+			if level != "" && line.level != level {
+				continue
+			}
+			if err := writeWSText(conn, line.text); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsQuery re-issues a backend query on an interval over conn, the WS
+// equivalent of tailQuery's SSE loop.
+func (h *HTTP) wsQuery(conn *websocket.Conn, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	idx, _ := strconv.Atoi(r.URL.Query().Get("endpoint"))
+	interval := DefaultTailInterval
+	if v := r.URL.Query().Get("interval"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			interval = d
+		}
+	}
+
+	if idx < 0 || idx >= len(h.Endpoints) {
+		writeWSText(conn, []byte(fmt.Sprintf("error: unknown endpoint %d", idx)))
+		return
+	}
+	endpoint := h.Endpoints[idx]
+
+	pingTicker := time.NewTicker(wsPingPeriod)
+	defer pingTicker.Stop()
+	queryTicker := time.NewTicker(interval)
+	defer queryTicker.Stop()
+
+	ctx := r.Context()
+	client := &http.Client{Timeout: h.requestTimeout()}
+
+	fetch := func() error {
+		resp, err := client.Get(fmt.Sprintf("%s/query?q=%s", endpoint.cfg.URI, url.QueryEscape(q)))
+		if err != nil {
+			return writeWSText(conn, []byte(fmt.Sprintf("error: %s", err)))
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return writeWSText(conn, body)
+	}
+
+	if err := fetch(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pingTicker.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-queryTicker.C:
+			if err := fetch(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeWSText frames p as a single WebSocket text message.
+func writeWSText(conn *websocket.Conn, p []byte) error {
+	w, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.Write(p)
+	bw.Flush()
+	return w.Close()
+}
@@ -0,0 +1,486 @@
+// Package spool is an on-disk, segmented write-ahead log that
+// relay.HTTP's processEndpoint falls back to when every configured InfluxDB backend
+// returns 5xx or times out. It turns the relay from a best-effort forwarder
+// into an at-least-once buffer across a downstream outage: writes are
+// fsync-batched to disk in gzip-compressed segments and a background
+// replayer drains them once the backend recovers.
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is one failed write, captured with enough to replay it later.
+type Entry struct {
+	Headers map[string]string
+	Target  string // the backend URI the write was originally destined for
+	Body    []byte // the raw line-protocol batch
+}
+
+// Config controls segment sizing and the replayer's retry behavior.
+type Config struct {
+	Dir string // directory the WAL segments are written under
+
+	MaxSegmentBytes int64         // rotate to a new segment at this size (default DefaultMaxSegmentBytes)
+	MaxSegmentAge   time.Duration // rotate to a new segment after this age (default DefaultMaxSegmentAge)
+
+	FsyncEvery time.Duration // how often the active segment is fsync'd (default DefaultFsyncInterval)
+
+	MinBackoff time.Duration // replay retry floor (default DefaultMinBackoff)
+	MaxBackoff time.Duration // replay retry ceiling (default DefaultMaxBackoff)
+}
+
+// Defaults applied to zero-valued Config fields.
+const (
+	DefaultMaxSegmentBytes = 64 * 1024 * 1024
+	DefaultMaxSegmentAge   = 5 * time.Minute
+	DefaultFsyncInterval   = 1 * time.Second
+	DefaultMinBackoff      = 1 * time.Second
+	DefaultMaxBackoff      = 2 * time.Minute
+)
+
+// Sender delivers a replayed Entry to its backend. Implemented by the
+// relay's HTTP.replaySender; kept as a function type here so
+// spool has no dependency on the relay package.
+type Sender func(Entry) error
+
+// Spool owns one endpoint's segment directory: the active segment being
+// appended to, the queue of closed segments waiting on the replayer, and
+// the replayer's pause/resume state.
+type Spool struct {
+	cfg Config
+
+	mu      sync.Mutex
+	active  *segment
+	paused  bool
+	closing chan struct{}
+}
+
+// Open creates (or resumes) a spool rooted at cfg.Dir, recovering any
+// segments left over from a previous run so they're replayed instead of
+// silently abandoned.
+func Open(cfg Config) (*Spool, error) {
+	if cfg.MaxSegmentBytes <= 0 {
+		cfg.MaxSegmentBytes = DefaultMaxSegmentBytes
+	}
+	if cfg.MaxSegmentAge <= 0 {
+		cfg.MaxSegmentAge = DefaultMaxSegmentAge
+	}
+	if cfg.FsyncEvery <= 0 {
+		cfg.FsyncEvery = DefaultFsyncInterval
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := recoverOrphanedSegments(cfg.Dir); err != nil {
+		return nil, err
+	}
+
+	return &Spool{cfg: cfg, closing: make(chan struct{})}, nil
+}
+
+// recoverOrphanedSegments seals any *.seg.gz.tmp left behind by a process
+// that died (or was killed without calling Close) before rotating its
+// active segment, so a restart replays it instead of losing it silently.
+// The gzip stream in an orphan may be truncated mid-record if the crash hit
+// mid-write; replaySegment treats that as a normal segment error, so it's
+// retried with backoff like any other failure and can be force-dropped via
+// /admin/spool if it's truly poisoned.
+func recoverOrphanedSegments(dir string) error {
+	orphans, err := filepath.Glob(filepath.Join(dir, "*.seg.gz.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range orphans {
+		sealed := tmp[:len(tmp)-len(".tmp")]
+		if err := os.Rename(tmp, sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write appends entry to the active segment, rotating to a new one first
+// if the current segment has hit its size or age bound.
+func (s *Spool) Write(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil || s.active.shouldRotate(s.cfg) {
+		if s.active != nil {
+			if err := s.active.closeSealed(); err != nil {
+				return err
+			}
+		}
+		seg, err := newSegment(s.cfg.Dir)
+		if err != nil {
+			return err
+		}
+		s.active = seg
+	}
+
+	return s.active.append(e, s.cfg.FsyncEvery)
+}
+
+// QueueDepth returns the number of sealed segments waiting to be replayed,
+// plus the active segment if it has any entries.
+func (s *Spool) QueueDepth() int {
+	segs, err := s.sealedSegments()
+	if err != nil {
+		return 0
+	}
+	n := len(segs)
+	s.mu.Lock()
+	if s.active != nil && s.active.count > 0 {
+		n++
+	}
+	s.mu.Unlock()
+	return n
+}
+
+// BacklogBytes sums the on-disk size of every segment not yet replayed.
+func (s *Spool) BacklogBytes() int64 {
+	entries, err := ioutil.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, fi := range entries {
+		if !fi.IsDir() {
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
+// OldestSegmentAge returns how long the oldest sealed segment has been
+// waiting since its file was last written, or zero if no sealed segment is
+// waiting. The active segment is not counted.
+func (s *Spool) OldestSegmentAge() time.Duration {
+	segs, err := s.sealedSegments()
+	if err != nil || len(segs) == 0 {
+		return 0
+	}
+	fi, err := os.Stat(segs[0])
+	if err != nil {
+		return 0
+	}
+	return time.Since(fi.ModTime())
+}
+
+// Pause stops the replayer from draining further segments without
+// affecting Write; Resume restarts it. Both are safe to call from the
+// /admin/spool handlers concurrently with a running Replay loop.
+func (s *Spool) Pause() {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+}
+
+func (s *Spool) Resume() {
+	s.mu.Lock()
+	s.paused = false
+	s.mu.Unlock()
+}
+
+func (s *Spool) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// Segments returns the base file names of every sealed segment waiting to
+// be replayed, oldest first, so callers like the /admin/spool GET handler
+// can surface valid names for DropSegment without reaching into the spool
+// directory themselves.
+func (s *Spool) Segments() []string {
+	segs, err := s.sealedSegments()
+	if err != nil {
+		return nil
+	}
+	names := make([]string, len(segs))
+	for i, seg := range segs {
+		names[i] = filepath.Base(seg)
+	}
+	return names
+}
+
+// DropSegment force-removes a poisoned segment (one the replayer can't get
+// past) by its base file name, as returned by Segments. It never removes
+// the active segment.
+func (s *Spool) DropSegment(name string) error {
+	if name == "" || filepath.Base(name) != name {
+		return fmt.Errorf("spool: invalid segment name %q", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil && filepath.Base(s.active.path) == name {
+		return fmt.Errorf("spool: refusing to drop the active segment %q", name)
+	}
+	return os.Remove(filepath.Join(s.cfg.Dir, name))
+}
+
+// Close seals the active segment so a restart picks it up for replay.
+func (s *Spool) Close() error {
+	close(s.closing)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil {
+		return s.active.closeSealed()
+	}
+	return nil
+}
+
+func (s *Spool) sealedSegments() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(s.cfg.Dir, "*.seg.gz"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// Replay runs until ctx-equivalent s.Close is called, repeatedly draining
+// the oldest sealed segment through send. A failed send is retried with
+// exponential backoff and jitter, honoring whatever per-endpoint rate
+// limiter the caller's send closure applies, so a recovering backend isn't
+// immediately re-overwhelmed by the backlog. offsets remembers how many
+// entries of each in-progress segment have already been confirmed sent, so
+// a segment with one poisoned entry near the end doesn't get its entire
+// successful prefix re-delivered to the backend on every retry.
+func (s *Spool) Replay(send Sender) {
+	backoff := s.cfg.MinBackoff
+	offsets := make(map[string]int)
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		default:
+		}
+
+		if s.isPaused() {
+			time.Sleep(s.cfg.MinBackoff)
+			continue
+		}
+
+		segs, err := s.sealedSegments()
+		if err != nil || len(segs) == 0 {
+			time.Sleep(s.cfg.MinBackoff)
+			continue
+		}
+
+		path := segs[0]
+		sent, err := replaySegment(path, offsets[path], send)
+		if err != nil {
+			offsets[path] = sent
+			jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
+			time.Sleep(backoff + jitter)
+			backoff *= 2
+			if backoff > s.cfg.MaxBackoff {
+				backoff = s.cfg.MaxBackoff
+			}
+			continue
+		}
+
+		delete(offsets, path)
+		backoff = s.cfg.MinBackoff
+		os.Remove(path)
+	}
+}
+
+// segment is one gzip-compressed WAL file: a sequence of length-prefixed,
+// gob-free binary records (a 4-byte target length, the target string, a
+// 4-byte headers length, the "Key: value" header lines, a 4-byte body
+// length, and the body) so replay doesn't need to unmarshal
+// anything fancier than a byte count.
+type segment struct {
+	path    string
+	file    *os.File
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	opened  time.Time
+	size    int64
+	count   int
+	fsynced time.Time
+}
+
+func newSegment(dir string) (*segment, error) {
+	name := fmt.Sprintf("%d.seg.gz.tmp", time.Now().UnixNano())
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &segment{
+		path:   f.Name(),
+		file:   f,
+		gz:     gz,
+		buf:    bufio.NewWriter(gz),
+		opened: time.Now(),
+	}, nil
+}
+
+func (sg *segment) shouldRotate(cfg Config) bool {
+	return sg.size >= cfg.MaxSegmentBytes || time.Since(sg.opened) >= cfg.MaxSegmentAge
+}
+
+func (sg *segment) append(e Entry, fsyncEvery time.Duration) error {
+	if err := writeFramed(sg.buf, []byte(e.Target)); err != nil {
+		return err
+	}
+	hdr := encodeHeaders(e.Headers)
+	if err := writeFramed(sg.buf, hdr); err != nil {
+		return err
+	}
+	if err := writeFramed(sg.buf, e.Body); err != nil {
+		return err
+	}
+	sg.count++
+	sg.size += int64(len(e.Target) + len(hdr) + len(e.Body) + 12)
+
+	if time.Since(sg.fsynced) >= fsyncEvery {
+		if err := sg.buf.Flush(); err != nil {
+			return err
+		}
+		if err := sg.gz.Flush(); err != nil {
+			return err
+		}
+		sg.fsynced = time.Now()
+		return sg.file.Sync()
+	}
+	return nil
+}
+
+// closeSealed flushes, fsyncs, and renames the segment from its .tmp name
+// to the sealed *.seg.gz name the replayer looks for, so a crash mid-write
+// never hands the replayer a half-written file.
+func (sg *segment) closeSealed() error {
+	if err := sg.buf.Flush(); err != nil {
+		return err
+	}
+	if err := sg.gz.Close(); err != nil {
+		return err
+	}
+	if err := sg.file.Sync(); err != nil {
+		return err
+	}
+	if err := sg.file.Close(); err != nil {
+		return err
+	}
+	sealed := sg.path[:len(sg.path)-len(".tmp")]
+	return os.Rename(sg.path, sealed)
+}
+
+func writeFramed(w io.Writer, b []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readFramed(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+func encodeHeaders(h map[string]string) []byte {
+	var out []byte
+	for k, v := range h {
+		out = append(out, []byte(k+": "+v+"\n")...)
+	}
+	return out
+}
+
+func decodeHeaders(b []byte) map[string]string {
+	h := make(map[string]string)
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			h[string(line[:i])] = string(bytes.TrimLeft(line[i+1:], " "))
+		}
+	}
+	return h
+}
+
+// replaySegment reads every entry out of path in order, skipping the first
+// skip entries (already confirmed sent on an earlier attempt at this same
+// segment), and hands the rest to send in order. It stops at the first
+// failure and returns how many entries have now been confirmed sent in
+// total, so the caller can resume from there next attempt instead of
+// re-sending the whole segment's already-successful prefix again.
+func replaySegment(path string, skip int, send Sender) (sent int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return skip, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return skip, err
+	}
+	defer gz.Close()
+
+	sent = skip
+	i := 0
+	r := bufio.NewReader(gz)
+	for {
+		target, err := readFramed(r)
+		if err == io.EOF {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+		rawHeaders, err := readFramed(r)
+		if err != nil {
+			return sent, err
+		}
+		body, err := readFramed(r)
+		if err != nil {
+			return sent, err
+		}
+
+		if i < skip {
+			i++
+			continue
+		}
+
+		e := Entry{Target: string(target), Headers: decodeHeaders(rawHeaders), Body: body}
+		if err := send(e); err != nil {
+			return sent, err
+		}
+		sent++
+		i++
+	}
+}